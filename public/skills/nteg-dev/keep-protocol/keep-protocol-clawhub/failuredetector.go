@@ -0,0 +1,287 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Packet.Typ values used by the failure detector. Typ 0/1/2 are already
+// spoken for (application message, server reply, legacy heartbeat), so the
+// probe types start at 10.
+const (
+	TypPing         = 10 // server -> suspect: are you alive?
+	TypAck          = 11 // suspect -> server: yes
+	TypIndirectPing = 12 // server -> helper: please ping suspect for me
+	TypIndirectAck  = 13 // helper -> server: I reached suspect
+	TypNack         = 14 // helper -> server: I could not reach suspect either
+)
+
+// Failure-detection knobs, overridable via -fd-* flags in main().
+var (
+	fdInterval     = 1 * time.Second        // how often the detector probes one random agent
+	fdProbeTimeout = 500 * time.Millisecond // RTT allowed for a direct or indirect ack
+	fdIndirectK    = 3                      // number of helpers asked to indirectly probe a suspect
+)
+
+// globalFailureDetector is initialized in main() once the -fd-* flags have
+// been parsed, and fed probe replies from handleConnection's routing switch.
+var globalFailureDetector *failureDetector
+
+// probe tracks one in-flight direct or indirect round awaiting an ack.
+type probe struct {
+	suspect string
+	// helpers is nil for a direct probe. For an indirect probe it's the set
+	// of identities that were actually asked to relay an ack, so a reply
+	// can be checked against who the detector dispatched rather than just
+	// the numeric seq, which any registered agent could guess or observe.
+	helpers map[string]bool
+	acked   chan struct{}
+}
+
+// failureDetector is a SWIM-inspired failure detector (hashicorp/memberlist
+// style): each tick it pings one random agent directly; if that times out,
+// it asks fdIndirectK other random agents to probe the suspect on its behalf
+// and relay the result. Only when both the direct probe and every indirect
+// probe time out is the agent declared dead and unregistered. This
+// distinguishes "suspect is actually gone" from "my link to suspect is bad".
+type failureDetector struct {
+	mu      sync.Mutex
+	nextSeq uint64
+	pending map[uint64]*probe
+}
+
+func newFailureDetector() *failureDetector {
+	return &failureDetector{pending: make(map[uint64]*probe)}
+}
+
+func (fd *failureDetector) run() {
+	ticker := time.NewTicker(fdInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		fd.tick()
+	}
+}
+
+func (fd *failureDetector) tick() {
+	suspect, conn := fd.randomAgent("")
+	if suspect == "" {
+		return // no agents registered
+	}
+
+	if fd.directProbe(suspect, conn) {
+		return
+	}
+	if fd.indirectProbe(suspect) {
+		return
+	}
+
+	log.Printf("failuredetector: %q unreachable via direct and indirect probes, marking dead", suspect)
+	routeMu.RLock()
+	entry, ok := agents[suspect]
+	routeMu.RUnlock()
+	// Only tear down the connection that was actually probed: if suspect
+	// reconnected (same key, new conn) during the probe window, agents[suspect]
+	// now points at that brand-new, healthy connection, and closing it instead
+	// of the stale one would kill a legitimate reconnect out from under a race
+	// with this detector.
+	if ok && entry.conn == conn {
+		unregisterConn(entry.conn)
+		entry.conn.Close()
+	}
+}
+
+// directProbe pings suspect and waits up to fdProbeTimeout for its ack.
+func (fd *failureDetector) directProbe(suspect string, conn net.Conn) bool {
+	seq, pr := fd.beginProbe(suspect)
+	defer fd.endProbe(seq)
+
+	ping := &Packet{Typ: TypPing, Src: "server", Dst: suspect, Body: strconv.FormatUint(seq, 10)}
+	if err := writePacket(conn, ping); err != nil {
+		log.Printf("failuredetector: direct ping to %q failed: %v", suspect, err)
+		return false
+	}
+	return fd.awaitAck(pr)
+}
+
+// indirectProbe asks up to fdIndirectK other agents to ping suspect on our
+// behalf, and waits up to fdProbeTimeout for any of them to relay an ack.
+func (fd *failureDetector) indirectProbe(suspect string) bool {
+	helpers := fd.randomHelpers(suspect, fdIndirectK)
+	if len(helpers) == 0 {
+		return false
+	}
+
+	seq, pr := fd.beginIndirectProbe(suspect, helpers)
+	defer fd.endProbe(seq)
+
+	body := strconv.FormatUint(seq, 10) + ":" + suspect
+	for helper, conn := range helpers {
+		ping := &Packet{Typ: TypIndirectPing, Src: "server", Dst: helper, Body: body}
+		if err := writePacket(conn, ping); err != nil {
+			log.Printf("failuredetector: indirect ping via %q failed: %v", helper, err)
+		}
+	}
+	return fd.awaitAck(pr)
+}
+
+func (fd *failureDetector) awaitAck(pr *probe) bool {
+	select {
+	case <-pr.acked:
+		return true
+	case <-time.After(fdProbeTimeout):
+		return false
+	}
+}
+
+func (fd *failureDetector) beginProbe(suspect string) (uint64, *probe) {
+	return fd.newProbe(suspect, nil)
+}
+
+// beginIndirectProbe is beginProbe for an indirect round: it additionally
+// records which helpers were dispatched, so handleResponse can confirm a
+// reply actually came from one of them.
+func (fd *failureDetector) beginIndirectProbe(suspect string, helpers map[string]net.Conn) (uint64, *probe) {
+	set := make(map[string]bool, len(helpers))
+	for id := range helpers {
+		set[id] = true
+	}
+	return fd.newProbe(suspect, set)
+}
+
+func (fd *failureDetector) newProbe(suspect string, helpers map[string]bool) (uint64, *probe) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.nextSeq++
+	seq := fd.nextSeq
+	pr := &probe{suspect: suspect, helpers: helpers, acked: make(chan struct{}, 1)}
+	fd.pending[seq] = pr
+	return seq, pr
+}
+
+func (fd *failureDetector) endProbe(seq uint64) {
+	fd.mu.Lock()
+	delete(fd.pending, seq)
+	fd.mu.Unlock()
+}
+
+// handleResponse feeds an Ack/IndirectAck/Nack packet addressed to "server"
+// back into the failure detector. Typ is expected to already be one of
+// those three; anything else is ignored. p.Src is trusted here: by the time
+// handleConnection's routing switch reaches this call, it has already
+// verified the packet's signature and that p.Src is bound to the signing
+// key, so it can't be forged by an unrelated agent.
+func (fd *failureDetector) handleResponse(p *Packet) {
+	var seq uint64
+	var suspect string
+	var ok bool
+	switch p.Typ {
+	case TypAck:
+		seq, ok = parseSeq(p.Body)
+	case TypIndirectAck, TypNack:
+		seq, suspect, ok = parseIndirectBody(p.Body)
+	default:
+		return
+	}
+	if !ok {
+		return
+	}
+
+	fd.mu.Lock()
+	pr, exists := fd.pending[seq]
+	fd.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	switch p.Typ {
+	case TypAck:
+		// A direct ack must come from the suspect itself: otherwise any
+		// other registered agent could guess or observe the small
+		// monotonic seq and vouch for a suspect it never reached.
+		if p.Src != pr.suspect {
+			log.Printf("failuredetector: dropped ack for seq %d: sender %q is not the probed suspect %q", seq, p.Src, pr.suspect)
+			return
+		}
+	case TypIndirectAck, TypNack:
+		if pr.suspect != suspect || !pr.helpers[p.Src] {
+			log.Printf("failuredetector: dropped indirect response for seq %d: sender %q was not one of the dispatched helpers for %q", seq, p.Src, pr.suspect)
+			return
+		}
+	}
+
+	if p.Typ == TypNack {
+		return // informational only: this helper couldn't reach the suspect either
+	}
+	select {
+	case pr.acked <- struct{}{}:
+	default:
+	}
+}
+
+// randomAgent returns a random registered identity and its connection,
+// excluding exclude.
+func (fd *failureDetector) randomAgent(exclude string) (string, net.Conn) {
+	routeMu.RLock()
+	defer routeMu.RUnlock()
+
+	candidates := make([]string, 0, len(agents))
+	for id := range agents {
+		if id != exclude {
+			candidates = append(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", nil
+	}
+	id := candidates[rand.Intn(len(candidates))]
+	return id, agents[id].conn
+}
+
+// randomHelpers returns up to k registered agents other than suspect,
+// mapped to their connections.
+func (fd *failureDetector) randomHelpers(suspect string, k int) map[string]net.Conn {
+	routeMu.RLock()
+	candidates := make([]string, 0, len(agents))
+	conns := make(map[string]net.Conn, len(agents))
+	for id, entry := range agents {
+		if id == suspect {
+			continue
+		}
+		candidates = append(candidates, id)
+		conns[id] = entry.conn
+	}
+	routeMu.RUnlock()
+
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+
+	helpers := make(map[string]net.Conn, len(candidates))
+	for _, id := range candidates {
+		helpers[id] = conns[id]
+	}
+	return helpers
+}
+
+func parseSeq(body string) (uint64, bool) {
+	seq, err := strconv.ParseUint(body, 10, 64)
+	return seq, err == nil
+}
+
+func parseIndirectBody(body string) (seq uint64, suspect string, ok bool) {
+	parts := strings.SplitN(body, ":", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return seq, parts[1], true
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFailureDetectorDirectProbeAcked(t *testing.T) {
+	legacyFraming = false
+	fdProbeTimeout = time.Second
+
+	serverSide, agentSide := net.Pipe()
+	defer serverSide.Close()
+	defer agentSide.Close()
+
+	fd := newFailureDetector()
+
+	go func() {
+		ping, err := readPacket(agentSide)
+		if err != nil {
+			return
+		}
+		ack := &Packet{Typ: TypAck, Src: "bot:weather", Body: ping.Body}
+		writePacket(agentSide, ack)
+	}()
+
+	// Stand in for handleConnection's routing switch, which hands probe
+	// replies addressed to the server to the detector.
+	go func() {
+		ack, err := readPacket(serverSide)
+		if err != nil {
+			return
+		}
+		fd.handleResponse(ack)
+	}()
+
+	if !fd.directProbe("bot:weather", serverSide) {
+		t.Fatalf("expected an acked direct probe to report the agent alive")
+	}
+}
+
+func TestFailureDetectorDirectProbeTimesOut(t *testing.T) {
+	legacyFraming = false
+	fdProbeTimeout = 50 * time.Millisecond
+
+	serverSide, agentSide := net.Pipe()
+	defer serverSide.Close()
+	defer agentSide.Close()
+
+	// Read the ping so directProbe's write on the unbuffered pipe completes,
+	// but never ack it.
+	go func() {
+		for {
+			if _, err := readPacket(agentSide); err != nil {
+				return
+			}
+		}
+	}()
+
+	fd := newFailureDetector()
+	if fd.directProbe("bot:weather", serverSide) {
+		t.Fatalf("expected a probe with no reply to time out")
+	}
+}
+
+func TestParseSeqAndIndirectBody(t *testing.T) {
+	seq, ok := parseSeq("42")
+	if !ok || seq != 42 {
+		t.Fatalf("parseSeq(42) = %d, %v", seq, ok)
+	}
+	if _, ok := parseSeq("not-a-number"); ok {
+		t.Fatalf("expected parseSeq to reject a non-numeric body")
+	}
+
+	seq, suspect, ok := parseIndirectBody("7:bot:weather@abc123")
+	if !ok || seq != 7 || suspect != "bot:weather@abc123" {
+		t.Fatalf("parseIndirectBody = %d, %q, %v", seq, suspect, ok)
+	}
+	if _, _, ok := parseIndirectBody("no-colon"); ok {
+		t.Fatalf("expected parseIndirectBody to reject a body with no separator")
+	}
+}
+
+func TestFailureDetectorHandleResponseAcksPendingProbe(t *testing.T) {
+	fd := newFailureDetector()
+	seq, pr := fd.beginProbe("bot:weather@abc123")
+	defer fd.endProbe(seq)
+
+	fd.handleResponse(&Packet{Typ: TypAck, Src: "bot:weather@abc123", Body: "999999"}) // unknown seq: ignored
+	select {
+	case <-pr.acked:
+		t.Fatalf("probe should not be acked by an unrelated seq")
+	default:
+	}
+
+	fd.handleResponse(&Packet{Typ: TypAck, Src: "bot:weather@abc123", Body: strconv.FormatUint(seq, 10)})
+	select {
+	case <-pr.acked:
+	default:
+		t.Fatalf("expected the matching seq to ack the pending probe")
+	}
+}
+
+func TestFailureDetectorHandleResponseRejectsAckFromWrongSender(t *testing.T) {
+	fd := newFailureDetector()
+	seq, pr := fd.beginProbe("bot:weather@abc123")
+	defer fd.endProbe(seq)
+
+	// Some other registered agent guesses/observes the seq and tries to
+	// vouch for a suspect it never actually probed.
+	fd.handleResponse(&Packet{Typ: TypAck, Src: "bot:imposter@def456", Body: strconv.FormatUint(seq, 10)})
+	select {
+	case <-pr.acked:
+		t.Fatalf("an ack from an agent other than the probed suspect must not ack the probe")
+	default:
+	}
+}
+
+func TestFailureDetectorHandleResponseIgnoresNack(t *testing.T) {
+	fd := newFailureDetector()
+	seq, pr := fd.beginIndirectProbe("bot:weather@abc123", map[string]net.Conn{"bot:helper@aaa111": nil})
+	defer fd.endProbe(seq)
+
+	body := strconv.FormatUint(seq, 10) + ":bot:weather@abc123"
+	fd.handleResponse(&Packet{Typ: TypNack, Src: "bot:helper@aaa111", Body: body})
+	select {
+	case <-pr.acked:
+		t.Fatalf("a nack must not ack the probe")
+	default:
+	}
+}
+
+func TestFailureDetectorTickDoesNotKillAReconnectedAgent(t *testing.T) {
+	resetRoutingTables()
+	legacyFraming = false
+	fdProbeTimeout = 100 * time.Millisecond
+
+	pub, _ := mustGenKey(t)
+	identity := "bot:weather@" + pubKeyHash(pub)
+
+	oldServerSide, oldAgentSide := net.Pipe()
+	defer oldAgentSide.Close()
+	if !registerConn(identity, oldServerSide, pub) {
+		t.Fatalf("expected initial registration to succeed")
+	}
+
+	// The stale connection: it receives the direct probe's ping (so
+	// directProbe's write doesn't block forever) but never acks, so the
+	// probe times out as if the agent had actually gone dark.
+	go func() {
+		for {
+			if _, err := readPacket(oldAgentSide); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Mid-probe, the same identity reconnects on a brand-new connection, as
+	// a legitimately reconnecting agent would. registerConn itself already
+	// closes the stale oldServerSide as part of the swap.
+	newServerSide, newAgentSide := net.Pipe()
+	defer newAgentSide.Close()
+	go func() {
+		time.Sleep(fdProbeTimeout / 3)
+		if !registerConn(identity, newServerSide, pub) {
+			t.Errorf("expected the reconnect to succeed")
+		}
+	}()
+
+	fd := newFailureDetector()
+	fd.tick()
+
+	routeMu.RLock()
+	entry, ok := agents[identity]
+	routeMu.RUnlock()
+	if !ok {
+		t.Fatalf("expected the reconnected agent to still be registered after tick()")
+	}
+	if entry.conn != newServerSide {
+		t.Fatalf("expected the reconnected agent's new connection to remain registered")
+	}
+}
+
+func TestFailureDetectorHandleResponseRejectsIndirectAckFromNonHelper(t *testing.T) {
+	fd := newFailureDetector()
+	seq, pr := fd.beginIndirectProbe("bot:weather@abc123", map[string]net.Conn{"bot:helper@aaa111": nil})
+	defer fd.endProbe(seq)
+
+	body := strconv.FormatUint(seq, 10) + ":bot:weather@abc123"
+	fd.handleResponse(&Packet{Typ: TypIndirectAck, Src: "bot:bystander@bbb222", Body: body})
+	select {
+	case <-pr.acked:
+		t.Fatalf("an indirect ack from an agent that was never dispatched as a helper must not ack the probe")
+	default:
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReadWritePacketRoundTrip(t *testing.T) {
+	legacyFraming = false
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	sent := &Packet{Typ: 1, Src: "server", Body: "done"}
+	done := make(chan error, 1)
+	go func() { done <- writePacket(client, sent) }()
+
+	got, err := readPacket(server)
+	if err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	if got.Body != sent.Body || got.Src != sent.Src {
+		t.Fatalf("got %+v, want %+v", got, sent)
+	}
+}
+
+func TestReadWritePacketLegacyFraming(t *testing.T) {
+	legacyFraming = true
+	defer func() { legacyFraming = false }()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	sent := &Packet{Typ: 1, Src: "server", Body: "done"}
+	done := make(chan error, 1)
+	go func() { done <- writePacket(client, sent) }()
+
+	got, err := readPacket(server)
+	if err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	if got.Body != sent.Body {
+		t.Fatalf("got %+v, want %+v", got, sent)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+)
+
+func mustGenKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return pub, priv
+}
+
+func resetRoutingTables() {
+	routeMu.Lock()
+	agents = make(map[string]*identityEntry)
+	connSrc = make(map[net.Conn]string)
+	routeMu.Unlock()
+}
+
+func TestIdentityMatchesKey(t *testing.T) {
+	pub, _ := mustGenKey(t)
+	other, _ := mustGenKey(t)
+
+	identity := "bot:weather@" + pubKeyHash(pub)
+	if !identityMatchesKey(identity, pub) {
+		t.Fatalf("expected %q to match its own key", identity)
+	}
+	if identityMatchesKey(identity, other) {
+		t.Fatalf("expected %q to not match a different key", identity)
+	}
+	if identityMatchesKey("bot:weather", pub) {
+		t.Fatalf("expected identity without @pkhash suffix to be rejected")
+	}
+}
+
+func TestRegisterConnReconnectSameKey(t *testing.T) {
+	resetRoutingTables()
+	pub, _ := mustGenKey(t)
+	identity := "bot:weather@" + pubKeyHash(pub)
+
+	oldConn, _ := net.Pipe()
+	defer oldConn.Close()
+	if !registerConn(identity, oldConn, pub) {
+		t.Fatalf("expected initial registration to succeed")
+	}
+
+	newConn, _ := net.Pipe()
+	defer newConn.Close()
+	if !registerConn(identity, newConn, pub) {
+		t.Fatalf("expected reconnect with the same key to succeed")
+	}
+
+	routeMu.RLock()
+	entry := agents[identity]
+	routeMu.RUnlock()
+	if entry.conn != newConn {
+		t.Fatalf("expected %q to now route to the new connection", identity)
+	}
+	if _, stillThere := connSrc[oldConn]; stillThere {
+		t.Fatalf("expected old connection to be evicted from connSrc")
+	}
+}
+
+func TestRegisterConnRejectsImpersonation(t *testing.T) {
+	resetRoutingTables()
+	pub, _ := mustGenKey(t)
+	attacker, _ := mustGenKey(t)
+	identity := "bot:weather@" + pubKeyHash(pub)
+
+	legit, _ := net.Pipe()
+	defer legit.Close()
+	if !registerConn(identity, legit, pub) {
+		t.Fatalf("expected initial registration to succeed")
+	}
+
+	impostor, _ := net.Pipe()
+	defer impostor.Close()
+	if registerConn(identity, impostor, attacker) {
+		t.Fatalf("expected registration with a different key to be rejected")
+	}
+
+	routeMu.RLock()
+	entry := agents[identity]
+	routeMu.RUnlock()
+	if entry.conn != legit {
+		t.Fatalf("expected legitimate connection to remain registered")
+	}
+}
+
+func TestVerifySigRejectsMalformedKeys(t *testing.T) {
+	p := &Packet{
+		Src:  "bot:weather@deadbeefcafe",
+		Sig:  make([]byte, ed25519.SignatureSize),
+		Pk:   make([]byte, 4), // too short
+		Body: "hi",
+	}
+	if verifySig(p) {
+		t.Fatalf("expected verifySig to reject a malformed (short) public key")
+	}
+}
@@ -1,43 +1,93 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
-	"time"
 
 	"google.golang.org/protobuf/proto"
+
+	"github.com/decimasudo/vahlamulticlawagent/public/skills/nteg-dev/keep-protocol/keep-protocol-clawhub/protoio"
+	"github.com/decimasudo/vahlamulticlawagent/public/skills/nteg-dev/keep-protocol/keep-protocol-clawhub/secretconn"
 )
 
 const MaxPacketSize = 65536
 
+// pkHashLen is the number of hex characters of sha256(pk) used in the
+// canonical identity suffix, e.g. "bot:weather@a1b2c3d4e5f6".
+const pkHashLen = 12
+
+// identityEntry binds a live connection to the public key that authenticated it.
+type identityEntry struct {
+	conn net.Conn
+	pk   ed25519.PublicKey
+}
+
 var (
-	agents  = make(map[string]net.Conn) // "bot:weather" -> conn
-	connSrc = make(map[net.Conn]string) // conn -> "bot:weather" (reverse)
+	agents  = make(map[string]*identityEntry) // "bot:weather@a1b2c3d4e5f6" -> {conn, pk}
+	connSrc = make(map[net.Conn]string)        // conn -> identity (reverse)
 	routeMu sync.RWMutex
 )
 
-// registerConn registers a connection under the given agent identity.
-// Last-write-wins: if the identity is already registered, the old connection is closed.
-func registerConn(identity string, conn net.Conn) {
+// insecureNoEncryption skips the secretconn handshake and speaks Packets
+// over plaintext TCP, for migration away from pre-handshake clients.
+var insecureNoEncryption bool
+
+// serverIdentityKey is this server's long-term ed25519 identity, used to
+// authenticate itself to peers during the secretconn handshake. Generated
+// fresh at startup.
+var serverIdentityKey ed25519.PrivateKey
+
+// pubKeyHash returns the canonical identity suffix for pk: the first
+// pkHashLen hex characters of sha256(pk).
+func pubKeyHash(pk ed25519.PublicKey) string {
+	sum := sha256.Sum256(pk)
+	return hex.EncodeToString(sum[:])[:pkHashLen]
+}
+
+// identityMatchesKey reports whether identity is a self-certified
+// "label@pkhash" string whose pkhash matches pk.
+func identityMatchesKey(identity string, pk ed25519.PublicKey) bool {
+	i := strings.LastIndex(identity, "@")
+	if i < 0 || i == len(identity)-1 {
+		return false
+	}
+	return identity[i+1:] == pubKeyHash(pk)
+}
+
+// registerConn registers a connection under the given agent identity, which
+// must already have been verified (via identityMatchesKey) to correspond to pk.
+// Reconnecting with the same key evicts the old connection (last-write-wins).
+// Claiming an identity already bound to a different key is rejected.
+func registerConn(identity string, conn net.Conn, pk ed25519.PublicKey) bool {
 	routeMu.Lock()
 	defer routeMu.Unlock()
 
-	if old, exists := agents[identity]; exists && old != conn {
+	if existing, exists := agents[identity]; exists && existing.conn != conn {
+		if !bytes.Equal(existing.pk, pk) {
+			return false
+		}
 		log.Printf("Identity %q re-registered, closing old connection", identity)
 		// Clean up reverse map for old connection
-		delete(connSrc, old)
-		old.Close()
+		delete(connSrc, existing.conn)
+		existing.conn.Close()
 	}
-	agents[identity] = conn
+	agents[identity] = &identityEntry{conn: conn, pk: append(ed25519.PublicKey(nil), pk...)}
 	connSrc[conn] = identity
+	return true
 }
 
 // unregisterConn removes a connection from the routing table.
@@ -52,9 +102,40 @@ func unregisterConn(conn net.Conn) {
 	}
 }
 
-// readPacket reads a length-prefixed protobuf Packet from conn.
-// Wire format: [4 bytes big-endian uint32 length][length bytes protobuf].
+// legacyFraming switches readPacket/writePacket back to the old fixed
+// 4-byte big-endian length prefix, for clients that haven't yet been
+// upgraded to the varint-delimited protoio framing. Compatibility shim:
+// remove once all clients have migrated.
+var legacyFraming bool
+
+// readPacket reads a length-prefixed protobuf Packet from conn using
+// protoio's varint framing (or the legacy fixed-width framing if
+// -legacy-framing is set).
 func readPacket(conn net.Conn) (*Packet, error) {
+	if legacyFraming {
+		return readPacketLegacy(conn)
+	}
+	var p Packet
+	if _, err := protoio.NewDelimitedReader(conn, MaxPacketSize).ReadMsg(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// writePacket serializes a Packet with a varint length prefix (protoio) and
+// writes it to conn, or with the legacy fixed-width prefix if
+// -legacy-framing is set.
+func writePacket(conn net.Conn, p *Packet) error {
+	if legacyFraming {
+		return writePacketLegacy(conn, p)
+	}
+	_, err := protoio.NewDelimitedWriter(conn).WriteMsg(p)
+	return err
+}
+
+// readPacketLegacy reads a length-prefixed protobuf Packet from conn.
+// Wire format: [4 bytes big-endian uint32 length][length bytes protobuf].
+func readPacketLegacy(conn net.Conn) (*Packet, error) {
 	var lenBuf [4]byte
 	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
 		return nil, err
@@ -80,8 +161,8 @@ func readPacket(conn net.Conn) (*Packet, error) {
 	return &p, nil
 }
 
-// writePacket serializes a Packet with a 4-byte big-endian length prefix and writes it to conn.
-func writePacket(conn net.Conn, p *Packet) error {
+// writePacketLegacy serializes a Packet with a 4-byte big-endian length prefix and writes it to conn.
+func writePacketLegacy(conn net.Conn, p *Packet) error {
 	data, err := proto.Marshal(p)
 	if err != nil {
 		return fmt.Errorf("marshal: %w", err)
@@ -102,30 +183,28 @@ func writePacket(conn net.Conn, p *Packet) error {
 	return nil
 }
 
-func heartbeat() {
-	ticker := time.NewTicker(60 * time.Second)
-	defer ticker.Stop()
-	for range ticker.C {
-		hb := &Packet{
-			Typ: 2,
-			Src: "server",
-		}
-		routeMu.Lock()
-		for identity, conn := range agents {
-			if err := writePacket(conn, hb); err != nil {
-				log.Printf("Heartbeat fail %s: %v", identity, err)
-				delete(connSrc, conn)
-				delete(agents, identity)
-				conn.Close()
-			}
-		}
-		routeMu.Unlock()
-	}
-}
-
 // verifySig checks the ed25519 signature on a Packet.
 // The signed payload is the Packet with sig and pk zeroed out, then serialized.
 func verifySig(p *Packet) bool {
+	// Reconstruct the exact bytes that were signed: a copy of the packet
+	// with sig and pk cleared.
+	return verifySigOver(p, &Packet{
+		Typ:  p.Typ,
+		Id:   p.Id,
+		Src:  p.Src,
+		Dst:  p.Dst,
+		Body: p.Body,
+		Fee:  p.Fee,
+		Ttl:  p.Ttl,
+		Scar: p.Scar,
+		// Sig and Pk intentionally omitted (zero value)
+	})
+}
+
+// verifySigOver checks p.Sig against signCopy, the subset of p's fields a
+// particular packet type's signature actually covers (see verifyRelayOpenSig
+// for a case where that's not all of p).
+func verifySigOver(p *Packet, signCopy *Packet) bool {
 	if len(p.Sig) == 0 || len(p.Pk) == 0 {
 		return false // unsigned packet
 	}
@@ -138,19 +217,6 @@ func verifySig(p *Packet) bool {
 		return false
 	}
 
-	// Reconstruct the exact bytes that were signed:
-	// a copy of the packet with sig and pk cleared.
-	signCopy := &Packet{
-		Typ:  p.Typ,
-		Id:   p.Id,
-		Src:  p.Src,
-		Dst:  p.Dst,
-		Body: p.Body,
-		Fee:  p.Fee,
-		Ttl:  p.Ttl,
-		Scar: p.Scar,
-		// Sig and Pk intentionally omitted (zero value)
-	}
 	signBytes, err := proto.Marshal(signCopy)
 	if err != nil {
 		log.Printf("Marshal for verify failed: %v", err)
@@ -161,9 +227,36 @@ func verifySig(p *Packet) bool {
 }
 
 func handleConnection(c net.Conn) {
-	defer c.Close()
 	addr := c.RemoteAddr().String()
-	defer unregisterConn(c)
+
+	// Wrap the raw TCP stream in an authenticated, encrypted channel before
+	// any Packet is read or written, so on-path observers can't see src,
+	// dst, or body, and can't substitute a different destination. The
+	// handshake authenticates the remote's long-term ed25519 identity,
+	// which channelPk then cross-checks against each packet's signing key.
+	var channelPk ed25519.PublicKey
+	if !insecureNoEncryption {
+		sc, err := secretconn.Handshake(c, serverIdentityKey)
+		if err != nil {
+			log.Printf("Handshake failed with %s: %v", addr, err)
+			c.Close()
+			return
+		}
+		c = sc
+		channelPk = sc.RemotePubKey()
+	}
+
+	// handedOff is set once this connection has been taken over by a relay
+	// session's pump goroutines (see handleRelayOpen): from that point on,
+	// raw bytes are tunneled straight through and this function must not
+	// also close or unregister the connection out from under the pumps.
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			c.Close()
+			unregisterConn(c)
+		}
+	}()
 
 	for {
 		p, err := readPacket(c)
@@ -174,6 +267,22 @@ func handleConnection(c net.Conn) {
 			return
 		}
 
+		// RELAY_OPEN is dispatched ahead of the generic signature/replay
+		// checks below only so a rejected request never falls through to
+		// them; handleRelayOpen performs the equivalent checks itself
+		// (signature, channelPk, replay, Src-to-key binding) regardless of
+		// call site, since it claims an identity (Src) just like any other
+		// packet. It only takes ownership of c — becoming a raw byte pipe
+		// for the relay session — when it actually opens one; otherwise
+		// handleConnection keeps reading ordinary Packets from c.
+		if p.Typ == TypRelayOpen {
+			if handleRelayOpen(c, p, channelPk) {
+				handedOff = true
+				return
+			}
+			continue
+		}
+
 		// Signature is REQUIRED — unsigned packets are logged and dropped
 		if len(p.Sig) == 0 && len(p.Pk) == 0 {
 			log.Printf("DROPPED unsigned packet from %s (src=%s body=%q)", addr, p.Src, p.Body)
@@ -185,9 +294,42 @@ func handleConnection(c net.Conn) {
 			continue
 		}
 
-		// Register agent identity from first valid packet's src field
+		if channelPk != nil && !bytes.Equal(p.Pk, channelPk) {
+			log.Printf("DROPPED packet from %s: signing key does not match the authenticated channel identity", addr)
+			continue
+		}
+
+		if packetExpired(p) {
+			log.Printf("DROPPED expired packet from %s (src=%s id=%s)", addr, p.Src, p.Id)
+			continue
+		}
+
+		// The Src-to-key binding check runs before the seen-ID cache is ever
+		// touched: checkAndRemember allocates a whole seenBucket (ring buffer
+		// plus bloom filters) the first time it sees a given Src, and each new
+		// bucket can push the least-recently-used sender's bucket, and with it
+		// that sender's replay history, out of the capped cache. An attacker
+		// who hasn't registered a real identity can mint an arbitrary, unique
+		// Src for every packet with a fresh keypair, so letting unverified
+		// Srcs reach the cache first would let forged senders churn out real
+		// ones — checking the binding first means a forged Src is dropped
+		// before it can allocate anything.
+		if p.Src != "" && !identityMatchesKey(p.Src, p.Pk) {
+			log.Printf("DROPPED impersonation attempt from %s (src=%s does not match signer key)", addr, p.Src)
+			continue
+		}
+
+		if p.Src != "" && globalSeenCache.checkAndRemember(p.Src, p.Id, packetDeadline(p)) {
+			log.Printf("DROPPED replay from %s (src=%s id=%s)", addr, p.Src, p.Id)
+			continue
+		}
+
+		// Register agent identity from first valid packet's src field.
 		if p.Src != "" {
-			registerConn(p.Src, c)
+			if !registerConn(p.Src, c, p.Pk) {
+				log.Printf("DROPPED impersonation attempt from %s (src=%s already bound to a different key)", addr, p.Src)
+				continue
+			}
 		}
 
 		log.Printf("From %s (typ %d): %s -> %s", p.Src, p.Typ, p.Body, p.Dst)
@@ -195,6 +337,14 @@ func handleConnection(c net.Conn) {
 		// Route based on dst field
 		switch {
 		case p.Dst == "server" || p.Dst == "":
+			switch p.Typ {
+			case TypAck, TypIndirectAck, TypNack:
+				// A reply to one of our own failure-detector probes, not an
+				// application message: hand it to the detector and don't reply.
+				globalFailureDetector.handleResponse(p)
+				continue
+			}
+
 			// Backward compatible: reply "done"
 			resp := &Packet{
 				Id:   p.Id,
@@ -210,7 +360,7 @@ func handleConnection(c net.Conn) {
 		default:
 			// Forward to registered agent
 			routeMu.RLock()
-			target, exists := agents[p.Dst]
+			entry, exists := agents[p.Dst]
 			routeMu.RUnlock()
 
 			if !exists {
@@ -229,7 +379,7 @@ func handleConnection(c net.Conn) {
 			}
 
 			// Forward original signed packet (preserving signature)
-			if err := writePacket(target, p); err != nil {
+			if err := writePacket(entry.conn, p); err != nil {
 				resp := &Packet{
 					Id:   p.Id,
 					Typ:  1,
@@ -249,13 +399,39 @@ func handleConnection(c net.Conn) {
 }
 
 func main() {
+	flag.DurationVar(&replayWindow, "replay-window", replayWindow, "how long a (src,id) pair is remembered when the packet carries no Ttl")
+	flag.DurationVar(&replaySkew, "replay-skew", replaySkew, "clock-skew tolerance applied to Ttl deadlines")
+	flag.IntVar(&replayPerSrc, "replay-cache-size", replayPerSrc, "recently-seen-id ring buffer capacity per sender")
+	flag.IntVar(&replayMaxSenders, "replay-max-senders", replayMaxSenders, "max distinct senders tracked by the replay cache at once before the least-recently-used one is evicted")
+	flag.BoolVar(&legacyFraming, "legacy-framing", legacyFraming, "use the old fixed 4-byte length-prefixed wire framing for pre-protoio clients")
+	flag.BoolVar(&insecureNoEncryption, "insecure-no-encryption", insecureNoEncryption, "skip the secretconn handshake and speak Packets over plaintext TCP (migration only)")
+	flag.DurationVar(&fdInterval, "fd-interval", fdInterval, "how often the failure detector probes one random agent")
+	flag.DurationVar(&fdProbeTimeout, "fd-probe-timeout", fdProbeTimeout, "RTT allowed for a direct or indirect probe ack")
+	flag.IntVar(&fdIndirectK, "fd-indirect-k", fdIndirectK, "number of helper agents asked to indirectly probe a suspect")
+	var peersFlag string
+	flag.StringVar(&peersFlag, "peers", "", "comma-separated allow-list of relay peer addresses RELAY_OPEN may dial (host:port or host:port=<hex ed25519 pubkey> to pin its identity)")
+	flag.Parse()
+
+	if err := parsePeers(peersFlag); err != nil {
+		log.Fatalf("parse -peers: %v", err)
+	}
+
+	globalSeenCache = newSeenCache(replayPerSrc)
+	globalFailureDetector = newFailureDetector()
+
+	var err error
+	_, serverIdentityKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("generate server identity key: %v", err)
+	}
+
 	l, err := net.Listen("tcp", ":9009")
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Println("keep listening on :9009")
 
-	go heartbeat()
+	go globalFailureDetector.run()
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
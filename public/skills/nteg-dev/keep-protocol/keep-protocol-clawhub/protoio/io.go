@@ -0,0 +1,124 @@
+// Package protoio implements varint-length-delimited framing for protobuf
+// messages, modeled on Tendermint's unbuffered delimited reader: a varint
+// length prefix followed by the message bytes. A Reader never reads past the
+// current message, so the underlying io.Reader (typically a net.Conn) can
+// safely be shared with other code between ReadMsg calls.
+package protoio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// DelimitedReader reads varint-length-delimited protobuf messages.
+type DelimitedReader interface {
+	// ReadMsg reads exactly one length-delimited message into msg and
+	// returns the number of bytes consumed (the varint prefix plus payload).
+	ReadMsg(msg proto.Message) (int, error)
+}
+
+// DelimitedWriter writes varint-length-delimited protobuf messages.
+type DelimitedWriter interface {
+	// WriteMsg marshals msg and writes it with a varint length prefix,
+	// returning the number of bytes written (the varint prefix plus payload).
+	WriteMsg(msg proto.Message) (int, error)
+}
+
+type varintReader struct {
+	r       io.Reader
+	maxSize int // 0 means unbounded
+	buf     []byte
+}
+
+// NewDelimitedReader returns a DelimitedReader over r that rejects any
+// message whose declared length exceeds maxSize (0 means unbounded).
+func NewDelimitedReader(r io.Reader, maxSize int) DelimitedReader {
+	return &varintReader{r: r, maxSize: maxSize}
+}
+
+func (v *varintReader) ReadMsg(msg proto.Message) (int, error) {
+	length, n, err := readUvarint(v.r)
+	if err != nil {
+		return n, err
+	}
+	if length > uint64(maxInt) || (v.maxSize > 0 && int(length) > v.maxSize) {
+		return n, fmt.Errorf("protoio: message size %d exceeds max %d", length, v.maxSize)
+	}
+
+	if cap(v.buf) < int(length) {
+		v.buf = make([]byte, length)
+	}
+	payload := v.buf[:length]
+	if _, err := io.ReadFull(v.r, payload); err != nil {
+		return n, err
+	}
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return n + int(length), fmt.Errorf("protoio: unmarshal: %w", err)
+	}
+	return n + int(length), nil
+}
+
+type varintWriter struct {
+	w io.Writer
+}
+
+// NewDelimitedWriter returns a DelimitedWriter over w.
+func NewDelimitedWriter(w io.Writer) DelimitedWriter {
+	return &varintWriter{w: w}
+}
+
+func (v *varintWriter) WriteMsg(msg proto.Message) (int, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return 0, fmt.Errorf("protoio: marshal: %w", err)
+	}
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+	if _, err := v.w.Write(lenBuf[:n]); err != nil {
+		return 0, err
+	}
+	if _, err := v.w.Write(data); err != nil {
+		return n, err
+	}
+	return n + len(data), nil
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// readUvarint reads a binary unsigned varint from r one byte at a time (r
+// need not implement io.ByteReader), returning the decoded value and the
+// number of bytes consumed. Reading one byte at a time keeps it from ever
+// consuming bytes belonging to the next message.
+func readUvarint(r io.Reader) (uint64, int, error) {
+	var x uint64
+	var s uint
+	var buf [1]byte
+	n := 0
+	for {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, n, err
+		}
+		n++
+		// Checked on every iteration, not just once a terminal byte shows up:
+		// a peer that keeps setting the continuation bit forever would
+		// otherwise never hit this bound and the loop would read unbounded
+		// bytes from an input that's already provably not a valid varint.
+		if n == binary.MaxVarintLen64 && buf[0] >= 0x80 {
+			return 0, n, fmt.Errorf("protoio: varint overflows 64 bits")
+		}
+		b := buf[0]
+		if b < 0x80 {
+			if n == binary.MaxVarintLen64 && b > 1 {
+				return 0, n, fmt.Errorf("protoio: varint overflows 64 bits")
+			}
+			x |= uint64(b) << s
+			return x, n, nil
+		}
+		x |= uint64(b&0x7f) << s
+		s += 7
+	}
+}
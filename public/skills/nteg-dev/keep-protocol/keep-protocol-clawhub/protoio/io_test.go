@@ -0,0 +1,86 @@
+package protoio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestWriteReadMsgRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewDelimitedWriter(&buf)
+
+	msg := wrapperspb.String("hello")
+	if _, err := w.WriteMsg(msg); err != nil {
+		t.Fatalf("WriteMsg: %v", err)
+	}
+
+	r := NewDelimitedReader(&buf, 0)
+	var out wrapperspb.StringValue
+	if _, err := r.ReadMsg(&out); err != nil {
+		t.Fatalf("ReadMsg: %v", err)
+	}
+	if out.Value != "hello" {
+		t.Fatalf("got %q, want %q", out.Value, "hello")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected ReadMsg to consume exactly the varint + payload, %d bytes left over", buf.Len())
+	}
+}
+
+func TestReadMsgRejectsOversizedMessage(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewDelimitedWriter(&buf)
+	if _, err := w.WriteMsg(wrapperspb.String("this message is too big for the limit")); err != nil {
+		t.Fatalf("WriteMsg: %v", err)
+	}
+
+	r := NewDelimitedReader(&buf, 4)
+	var out wrapperspb.StringValue
+	if _, err := r.ReadMsg(&out); err == nil {
+		t.Fatalf("expected ReadMsg to reject a message larger than maxSize")
+	}
+}
+
+func TestReadUvarintRejectsUnterminatedContinuationBytes(t *testing.T) {
+	// Every byte has the continuation bit set and none ever terminates the
+	// varint: readUvarint must bound this on byte count alone, since waiting
+	// for a terminal byte that never comes would otherwise read forever.
+	buf := bytes.Repeat([]byte{0x80}, 64)
+
+	_, n, err := readUvarint(bytes.NewReader(buf))
+	if err == nil {
+		t.Fatalf("expected an unterminated run of continuation bytes to be rejected")
+	}
+	if n > binary.MaxVarintLen64 {
+		t.Fatalf("expected readUvarint to stop within %d bytes, consumed %d", binary.MaxVarintLen64, n)
+	}
+}
+
+func TestReadMsgLeavesTrailingBytesUntouched(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewDelimitedWriter(&buf)
+	if _, err := w.WriteMsg(wrapperspb.String("first")); err != nil {
+		t.Fatalf("WriteMsg: %v", err)
+	}
+	if _, err := w.WriteMsg(wrapperspb.String("second")); err != nil {
+		t.Fatalf("WriteMsg: %v", err)
+	}
+
+	r := NewDelimitedReader(&buf, 0)
+	var out wrapperspb.StringValue
+	if _, err := r.ReadMsg(&out); err != nil {
+		t.Fatalf("ReadMsg: %v", err)
+	}
+	if out.Value != "first" {
+		t.Fatalf("got %q, want %q", out.Value, "first")
+	}
+	if _, err := r.ReadMsg(&out); err != nil {
+		t.Fatalf("ReadMsg (second): %v", err)
+	}
+	if out.Value != "second" {
+		t.Fatalf("got %q, want %q", out.Value, "second")
+	}
+}
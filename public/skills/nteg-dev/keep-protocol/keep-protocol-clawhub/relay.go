@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/decimasudo/vahlamulticlawagent/public/skills/nteg-dev/keep-protocol/keep-protocol-clawhub/secretconn"
+)
+
+// Packet.Typ values for circuit-relay control. The payload for these control
+// messages is carried in existing string/number fields rather than a
+// dedicated Via/Hops pair, since the Packet message in this tree has no such
+// fields yet — a real rollout would add them to the .proto schema alongside
+// this change. Until then: Body carries a comma-separated chain of relay
+// server addresses (the "via" list, next hop first) and Scar carries the
+// remaining hop count.
+const (
+	TypRelayOpen = 20 // requester -> server: open a relay session toward Dst
+	TypRelayOk   = 21 // server -> requester: Id is the new session id (or the request's Id if Dst is local and no session opens)
+)
+
+const (
+	defaultRelayHopLimit      = 8
+	defaultRelaySessionBudget = 1 << 20 // bytes of data allowed in flight per relay session
+	relaySessionChunk         = 4096    // bytes per pump iteration / budget token
+)
+
+// peerConfig is one entry in the configured peer allow-list: an address this
+// server may extend a relay session to, and optionally the exact identity it
+// must present during the secretconn handshake.
+type peerConfig struct {
+	pinnedKey ed25519.PublicKey // nil if the address is allow-listed but its identity isn't pinned
+}
+
+// peers is the configured, allow-listed set of other keep servers this
+// server may dial to extend a circuit-relay session, populated once at
+// startup from -peers and read-only thereafter. It's deliberately separate
+// from agents and from RELAY_OPEN's via chain: a client's via chain picks
+// which hop to extend through, but it can only ever name an address this
+// server's operator has already vetted. Without this allow-list, any
+// already-authenticated agent could point via at an arbitrary host (an
+// internal service, a cloud metadata endpoint) and turn this server into an
+// open SSRF relay — secretconn.Handshake on its own only proves the far end
+// holds *some* ed25519 key, not that it's a server this deployment trusts.
+var peers = make(map[string]*peerConfig)
+
+// registerPeer adds addr to the allow-listed peer set, optionally pinning
+// the identity it must present during the handshake.
+func registerPeer(addr string, pinnedKey ed25519.PublicKey) {
+	peers[addr] = &peerConfig{pinnedKey: pinnedKey}
+}
+
+// parsePeers parses the -peers flag into the allow-list: a comma-separated
+// list of "host:port" or "host:port=<hex ed25519 pubkey>" entries, the
+// latter pinning that peer's handshake identity.
+func parsePeers(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		addr, hexKey, pinned := strings.Cut(entry, "=")
+		var pinnedKey ed25519.PublicKey
+		if pinned {
+			keyBytes, err := hex.DecodeString(hexKey)
+			if err != nil {
+				return fmt.Errorf("peer %q: decode pinned key: %w", addr, err)
+			}
+			if len(keyBytes) != ed25519.PublicKeySize {
+				return fmt.Errorf("peer %q: pinned key must be %d bytes, got %d", addr, ed25519.PublicKeySize, len(keyBytes))
+			}
+			pinnedKey = keyBytes
+		}
+		registerPeer(addr, pinnedKey)
+	}
+	return nil
+}
+
+// dialPeer opens a fresh connection to the relay server at addr for one
+// relay session's exclusive use, refusing any addr that isn't in the
+// configured peer allow-list. Connections are never shared across sessions:
+// there's no session-id framing on this link, so two sessions pumping raw
+// bytes over the same socket would corrupt each other's streams. Each
+// session instead pays for its own dial and, like any other inbound
+// connection to a keep server, authenticates it with the same secretconn
+// handshake handleConnection requires on the accepting side (skipped only
+// under -insecure-no-encryption), so the peer isn't left blocked waiting for
+// a handshake that never comes. If the peer entry pins an identity, the
+// handshake's authenticated remote key must match it exactly.
+func dialPeer(addr string) (net.Conn, error) {
+	pc, allowed := peers[addr]
+	if !allowed {
+		return nil, fmt.Errorf("peer %q is not in the configured allow-list", addr)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if insecureNoEncryption {
+		return conn, nil
+	}
+	sc, err := secretconn.Handshake(conn, serverIdentityKey)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with peer %s: %w", addr, err)
+	}
+	if pc.pinnedKey != nil && !bytes.Equal(sc.RemotePubKey(), pc.pinnedKey) {
+		sc.Close()
+		return nil, fmt.Errorf("peer %q presented an identity that doesn't match its pinned key", addr)
+	}
+	return sc, nil
+}
+
+// relaySession is one circuit-relay tunnel: bytes read from legA are pumped
+// to legB and vice versa, subject to a bounded in-flight byte budget per
+// session. Sessions never share a peer connection (see dialPeer).
+type relaySession struct {
+	id        string
+	legA      net.Conn // the requesting agent's own connection to this server
+	legB      net.Conn // the destination agent's connection, or the next peer hop
+	budget    chan struct{}
+	closeOnce sync.Once
+}
+
+var (
+	relaySessions = make(map[string]*relaySession)
+	relayMu       sync.Mutex
+)
+
+func newRelaySession(id string, legA, legB net.Conn, budgetBytes int) *relaySession {
+	tokens := budgetBytes / relaySessionChunk
+	if tokens < 1 {
+		tokens = 1
+	}
+	rs := &relaySession{id: id, legA: legA, legB: legB, budget: make(chan struct{}, tokens)}
+	for i := 0; i < tokens; i++ {
+		rs.budget <- struct{}{}
+	}
+	return rs
+}
+
+// registerRelaySession records rs and starts the two goroutines that pump
+// bytes between its legs.
+func registerRelaySession(rs *relaySession) {
+	relayMu.Lock()
+	relaySessions[rs.id] = rs
+	relayMu.Unlock()
+
+	go rs.pump(rs.legA, rs.legB)
+	go rs.pump(rs.legB, rs.legA)
+}
+
+// pump copies bytes from src to dst, acquiring one budget token per chunk
+// and releasing it once the chunk is actually written, so the total bytes
+// in flight for this session never exceeds its budget. Either leg ending
+// (EOF or error) tears down the whole session.
+func (rs *relaySession) pump(src, dst net.Conn) {
+	defer rs.close()
+
+	buf := make([]byte, relaySessionChunk)
+	for {
+		<-rs.budget
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				rs.budget <- struct{}{}
+				return
+			}
+		}
+		rs.budget <- struct{}{}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (rs *relaySession) close() {
+	rs.closeOnce.Do(func() {
+		relayMu.Lock()
+		delete(relaySessions, rs.id)
+		relayMu.Unlock()
+		rs.legA.Close()
+		rs.legB.Close()
+		log.Printf("Relay session %s closed", rs.id)
+	})
+}
+
+func newRelaySessionID() string {
+	var b [8]byte
+	rand.Read(b[:]) //nolint:errcheck // crypto/rand.Read never errors on this platform's Reader
+	return hex.EncodeToString(b[:])
+}
+
+// verifyRelayOpenSig checks the ed25519 signature on a RELAY_OPEN packet.
+// Unlike verifySig, the signed payload excludes Body and Scar: those carry
+// the remaining via chain and hop budget, which every server along the
+// chain rewrites before forwarding, so they can't be part of what the
+// original requester signed. Only the identity claim (Src/Dst/Id) and the
+// fields that stay constant hop to hop (Fee/Ttl) are covered, which is
+// exactly what needs to survive forwarding unmodified for the next hop to
+// still verify it against the same signature.
+func verifyRelayOpenSig(p *Packet) bool {
+	return verifySigOver(p, &Packet{Typ: p.Typ, Id: p.Id, Src: p.Src, Dst: p.Dst, Fee: p.Fee, Ttl: p.Ttl})
+}
+
+// handleRelayOpen processes a RELAY_OPEN request arriving on c: p.Dst is the
+// final agent identity, p.Body is the remaining via chain, and p.Scar is the
+// remaining hop budget. It reports whether it took ownership of c (true) by
+// opening a raw-byte relay session on it, or left c for the caller to keep
+// reading ordinary Packets from (false) — either because the request was
+// rejected, or because Dst turned out to be reachable here directly and no
+// tunnel was needed.
+//
+// RELAY_OPEN claims an identity (Src) just like any other packet, so it's
+// authenticated the same way: signed, with Src bound to the signing key and
+// to the authenticated channel identity (channelPk), exactly like
+// verifySig/identityMatchesKey/channelPk checks elsewhere in handleConnection.
+// Without this, any client could open a session under a forged Src and have
+// it acked and forwarded as that identity.
+func handleRelayOpen(c net.Conn, p *Packet, channelPk ed25519.PublicKey) bool {
+	if !verifyRelayOpenSig(p) {
+		log.Printf("DROPPED relay open for %q: missing or invalid signature", p.Dst)
+		return false
+	}
+	if channelPk != nil && !bytes.Equal(p.Pk, channelPk) {
+		log.Printf("DROPPED relay open for %q: signing key does not match the authenticated channel identity", p.Dst)
+		return false
+	}
+	if p.Src == "" || !identityMatchesKey(p.Src, p.Pk) {
+		log.Printf("DROPPED relay open for %q: src %q does not match signer key", p.Dst, p.Src)
+		return false
+	}
+	if packetExpired(p) {
+		log.Printf("DROPPED expired relay open for %q (src=%s id=%s)", p.Dst, p.Src, p.Id)
+		return false
+	}
+	if globalSeenCache.checkAndRemember(p.Src, p.Id, packetDeadline(p)) {
+		log.Printf("DROPPED replayed relay open for %q (src=%s id=%s)", p.Dst, p.Src, p.Id)
+		return false
+	}
+
+	if p.Scar <= 0 {
+		log.Printf("DROPPED relay open for %q: hop limit exceeded", p.Dst)
+		return false
+	}
+
+	routeMu.RLock()
+	_, localAgent := agents[p.Dst]
+	routeMu.RUnlock()
+
+	if localAgent {
+		// Dst is already reachable here through the ordinary per-packet
+		// routing switch in handleConnection, so no tunnel is needed.
+		// Piping raw bytes into Dst's own net.Conn would race with Dst's
+		// own handleConnection goroutine, which is still the sole
+		// reader/writer of that connection's framed Packet stream: ack the
+		// request and let application packets addressed to Dst flow
+		// through the normal routing path instead.
+		ack := &Packet{Typ: TypRelayOk, Id: p.Id, Src: "server", Dst: p.Src}
+		if err := writePacket(c, ack); err != nil {
+			log.Printf("Relay open for %q: ack failed: %v", p.Dst, err)
+		}
+		log.Printf("Relay open for %q: resolved to a local agent, no tunnel needed", p.Dst)
+		return false
+	}
+
+	via := strings.Split(p.Body, ",")
+	if len(via) == 0 || via[0] == "" {
+		log.Printf("DROPPED relay open for %q: not connected here and no via hops left", p.Dst)
+		return false
+	}
+	nextHop := via[0]
+
+	peerConn, err := dialPeer(nextHop)
+	if err != nil {
+		log.Printf("Relay open for %q: dial peer %q: %v", p.Dst, nextHop, err)
+		return false
+	}
+	// Body and Scar are rewritten for the next hop, but everything
+	// verifyRelayOpenSig actually checks (Id/Src/Dst/Fee/Ttl) and the
+	// signature itself carry straight through unmodified, so the next
+	// server can verify this is still the same signed request from Src.
+	forward := &Packet{
+		Typ:  TypRelayOpen,
+		Id:   p.Id,
+		Src:  p.Src,
+		Dst:  p.Dst,
+		Body: strings.Join(via[1:], ","),
+		Fee:  p.Fee,
+		Ttl:  p.Ttl,
+		Scar: p.Scar - 1,
+		Sig:  p.Sig,
+		Pk:   p.Pk,
+	}
+	if err := writePacket(peerConn, forward); err != nil {
+		log.Printf("Relay open for %q: forward to peer %q: %v", p.Dst, nextHop, err)
+		return false
+	}
+
+	rs := newRelaySession(newRelaySessionID(), c, peerConn, defaultRelaySessionBudget)
+	ack := &Packet{Typ: TypRelayOk, Id: rs.id, Src: "server", Dst: p.Src}
+	if err := writePacket(c, ack); err != nil {
+		log.Printf("Relay open for %q: ack failed: %v", p.Dst, err)
+		return false
+	}
+
+	registerRelaySession(rs)
+	log.Printf("Relay session %s opened: %s -> %s", rs.id, p.Src, p.Dst)
+	return true
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Replay-defense knobs, overridable via -replay-* flags in main().
+var (
+	replayWindow     = 5 * time.Minute  // remembered-id lifetime when a packet carries no Ttl
+	replaySkew       = 30 * time.Second // clock-skew tolerance applied to Ttl deadlines
+	replayPerSrc     = 4096             // ring buffer capacity per sender
+	replayBloomM     = 1 << 16          // bloom filter bit count for ids aged out of the ring
+	replayMaxSenders = 4096             // max distinct senders tracked at once before the oldest is evicted
+)
+
+// bloom is a small fixed-size Bloom filter used to catch replays of ids that
+// have already aged out of a seenBucket's ring buffer. A false positive just
+// means an occasional legitimate packet is dropped as a "replay" near the
+// boundary of the window; the filter never produces a false negative, so a
+// genuine replay can't slip through once it has been added.
+type bloom struct {
+	bits []uint64
+}
+
+func newBloom(m int) *bloom {
+	return &bloom{bits: make([]uint64, (m+63)/64)}
+}
+
+func (b *bloom) indices(s string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	n := uint32(len(b.bits) * 64)
+	return uint32(sum) % n, uint32(sum>>32) % n
+}
+
+func (b *bloom) add(s string) {
+	i1, i2 := b.indices(s)
+	b.bits[i1/64] |= 1 << (i1 % 64)
+	b.bits[i2/64] |= 1 << (i2 % 64)
+}
+
+func (b *bloom) mightContain(s string) bool {
+	i1, i2 := b.indices(s)
+	return b.bits[i1/64]&(1<<(i1%64)) != 0 && b.bits[i2/64]&(1<<(i2%64)) != 0
+}
+
+// seenEntry is one remembered (id, expiry) pair in a seenBucket's ring.
+type seenEntry struct {
+	id     string
+	expiry time.Time
+}
+
+// seenBucket is the per-sender recently-seen-id cache: a bounded ring buffer
+// for exact, fast lookups plus a pair of bloom filters catching ids that have
+// aged out of the ring but could still fall within their packet's TTL
+// window. The bloom filters are double-buffered and rotated every
+// replayWindow (see rotateAgedLocked): without that rotation, a filter that
+// only ever grows eventually saturates and starts flagging everything as a
+// replay, regardless of how long the ids it protects are actually supposed
+// to be remembered for.
+type seenBucket struct {
+	mu            sync.Mutex
+	cap           int
+	ring          []seenEntry
+	index         map[string]time.Time
+	agedCur       *bloom
+	agedPrev      *bloom
+	agedRotatedAt time.Time
+}
+
+func newSeenBucket(capacity int) *seenBucket {
+	return &seenBucket{
+		cap:           capacity,
+		index:         make(map[string]time.Time, capacity),
+		agedCur:       newBloom(replayBloomM),
+		agedPrev:      newBloom(replayBloomM),
+		agedRotatedAt: time.Now(),
+	}
+}
+
+// rotateAgedLocked swaps agedCur into agedPrev and starts a fresh agedCur
+// once a full replayWindow has elapsed since the last rotation, so an id
+// aged out of the ring is only remembered for one-to-two replayWindows
+// rather than forever. Callers must hold b.mu.
+func (b *seenBucket) rotateAgedLocked(now time.Time) {
+	if now.Sub(b.agedRotatedAt) < replayWindow {
+		return
+	}
+	b.agedPrev = b.agedCur
+	b.agedCur = newBloom(replayBloomM)
+	b.agedRotatedAt = now
+}
+
+// checkAndRemember reports whether id has already been seen for this bucket's
+// sender. If not, it's remembered until expiry (or until evicted from the
+// ring by newer ids, at which point the bloom filters take over).
+func (b *seenBucket) checkAndRemember(id string, expiry time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.rotateAgedLocked(now)
+
+	if exp, ok := b.index[id]; ok && now.Before(exp) {
+		return true
+	}
+	if b.agedCur.mightContain(id) || b.agedPrev.mightContain(id) {
+		return true
+	}
+
+	if len(b.ring) >= b.cap {
+		oldest := b.ring[0]
+		b.ring = b.ring[1:]
+		delete(b.index, oldest.id)
+		b.agedCur.add(oldest.id)
+	}
+	b.ring = append(b.ring, seenEntry{id: id, expiry: expiry})
+	b.index[id] = expiry
+	return false
+}
+
+// seenCache shards seenBuckets by sender identity so one noisy or malicious
+// sender can't evict another sender's recently-seen ids. The sender identity
+// used to shard is whatever the caller passes as src (typically a packet's
+// self-certified Src label) — that label costs its holder nothing to change,
+// so the number of distinct buckets is capped at maxBuckets and the
+// least-recently-used one is evicted to make room for a new sender. Without
+// this cap, a single already-authenticated connection that resigns its own
+// key under a fresh label on every packet (each one legitimately
+// self-certified, so it can't be rejected as an impersonation attempt) would
+// otherwise allocate one more ~16KiB bucket forever.
+type seenCache struct {
+	mu         sync.Mutex
+	perSrc     int
+	maxBuckets int
+	buckets    map[string]*seenBucket
+	lru        *list.List // front = most recently used src
+	lruElem    map[string]*list.Element
+}
+
+func newSeenCache(perSrc int) *seenCache {
+	return newSeenCacheWithMax(perSrc, replayMaxSenders)
+}
+
+func newSeenCacheWithMax(perSrc, maxBuckets int) *seenCache {
+	return &seenCache{
+		perSrc:     perSrc,
+		maxBuckets: maxBuckets,
+		buckets:    make(map[string]*seenBucket),
+		lru:        list.New(),
+		lruElem:    make(map[string]*list.Element),
+	}
+}
+
+func (c *seenCache) checkAndRemember(src, id string, expiry time.Time) bool {
+	c.mu.Lock()
+	b, ok := c.buckets[src]
+	if !ok {
+		b = newSeenBucket(c.perSrc)
+		c.buckets[src] = b
+		c.lruElem[src] = c.lru.PushFront(src)
+		c.evictLRULocked()
+	} else {
+		c.lru.MoveToFront(c.lruElem[src])
+	}
+	c.mu.Unlock()
+	return b.checkAndRemember(id, expiry)
+}
+
+// evictLRULocked drops the least-recently-used sender's bucket until at most
+// maxBuckets remain. Callers must hold c.mu. A maxBuckets of 0 or less
+// disables the cap entirely.
+func (c *seenCache) evictLRULocked() {
+	if c.maxBuckets <= 0 {
+		return
+	}
+	for len(c.buckets) > c.maxBuckets {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			return
+		}
+		src := oldest.Value.(string)
+		c.lru.Remove(oldest)
+		delete(c.lruElem, src)
+		delete(c.buckets, src)
+	}
+}
+
+// globalSeenCache is initialized in main() once the replay-defense flags have
+// been parsed, and checked from handleConnection on every signed packet.
+var globalSeenCache *seenCache
+
+// packetDeadline returns the absolute instant after which p is considered
+// expired. A Ttl of 0 means the packet carries no deadline, so it is given
+// replayWindow from now instead.
+func packetDeadline(p *Packet) time.Time {
+	if p.Ttl == 0 {
+		return time.Now().Add(replayWindow)
+	}
+	return time.Unix(p.Ttl, 0)
+}
+
+// packetExpired reports whether p's Ttl deadline has passed, allowing for
+// replaySkew of clock disagreement between sender and server.
+func packetExpired(p *Packet) bool {
+	if p.Ttl == 0 {
+		return false
+	}
+	return time.Now().After(packetDeadline(p).Add(replaySkew))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSeenCacheNormalFlow(t *testing.T) {
+	c := newSeenCache(16)
+	expiry := time.Now().Add(time.Minute)
+
+	if c.checkAndRemember("bot:weather", "id-1", expiry) {
+		t.Fatalf("expected a fresh id to not be flagged as a replay")
+	}
+}
+
+func TestSeenCacheDuplicateID(t *testing.T) {
+	c := newSeenCache(16)
+	expiry := time.Now().Add(time.Minute)
+
+	if c.checkAndRemember("bot:weather", "id-1", expiry) {
+		t.Fatalf("first sighting of id-1 should not be a replay")
+	}
+	if !c.checkAndRemember("bot:weather", "id-1", expiry) {
+		t.Fatalf("second sighting of id-1 should be flagged as a replay")
+	}
+	// A different sender reusing the same id is unrelated.
+	if c.checkAndRemember("bot:other", "id-1", expiry) {
+		t.Fatalf("same id from a different sender should not be a replay")
+	}
+}
+
+func TestSeenCacheEvictsLRUBeyondMaxBuckets(t *testing.T) {
+	c := newSeenCacheWithMax(16, 2)
+	expiry := time.Now().Add(time.Minute)
+
+	c.checkAndRemember("bot:a", "id-1", expiry)
+	c.checkAndRemember("bot:b", "id-1", expiry)
+	// Touch bot:a again so bot:b, not bot:a, is the least recently used.
+	c.checkAndRemember("bot:a", "id-2", expiry)
+	c.checkAndRemember("bot:c", "id-1", expiry)
+
+	c.mu.Lock()
+	_, hasA := c.buckets["bot:a"]
+	_, hasB := c.buckets["bot:b"]
+	_, hasC := c.buckets["bot:c"]
+	n := len(c.buckets)
+	c.mu.Unlock()
+
+	if n != 2 {
+		t.Fatalf("expected at most 2 buckets to survive, got %d", n)
+	}
+	if hasB {
+		t.Fatalf("expected bot:b, the least recently used sender, to be evicted")
+	}
+	if !hasA || !hasC {
+		t.Fatalf("expected the two most recently used senders, bot:a and bot:c, to survive")
+	}
+}
+
+// TestHandleConnectionBoundsBucketGrowthForResignedLabelsUnderOneKey covers
+// the attack identityMatchesKey alone can't stop: a single already-
+// handshaked connection resigning the same key under a brand-new
+// self-certified label on every packet. Each label legitimately hashes to
+// its own signing key, so none of them can be dropped as impersonation —
+// the cache's LRU cap on distinct buckets is what has to bound the damage.
+func TestHandleConnectionBoundsBucketGrowthForResignedLabelsUnderOneKey(t *testing.T) {
+	resetRoutingTables()
+	const maxBuckets = 8
+	globalSeenCache = newSeenCacheWithMax(16, maxBuckets)
+	insecureNoEncryption = true
+	defer func() { insecureNoEncryption = false }()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go handleConnection(server)
+
+	pub, priv := mustGenKey(t)
+	hash := pubKeyHash(pub)
+
+	sign := func(p *Packet) {
+		p.Pk = pub
+		signCopy := &Packet{Typ: p.Typ, Id: p.Id, Src: p.Src, Dst: p.Dst, Body: p.Body, Fee: p.Fee, Ttl: p.Ttl, Scar: p.Scar}
+		data, err := proto.Marshal(signCopy)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		p.Sig = ed25519.Sign(priv, data)
+	}
+
+	const attempts = 50
+	for i := 0; i < attempts; i++ {
+		p := &Packet{Typ: 1, Id: fmt.Sprintf("id-%d", i), Src: fmt.Sprintf("x-%d@%s", i, hash), Dst: "server"}
+		sign(p)
+		if err := writePacket(client, p); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+		// Each label is validly self-certified, so handleConnection replies
+		// "done" to every packet; read it so the unbuffered pipe doesn't
+		// block the next write.
+		if _, err := readPacket(client); err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+	}
+
+	sentinel := &Packet{Typ: 1, Id: "sentinel", Src: fmt.Sprintf("x-sentinel@%s", hash), Dst: "server"}
+	sign(sentinel)
+	if err := writePacket(client, sentinel); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	if _, err := readPacket(client); err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+
+	globalSeenCache.mu.Lock()
+	n := len(globalSeenCache.buckets)
+	globalSeenCache.mu.Unlock()
+	if n > maxBuckets {
+		t.Fatalf("expected the replay cache to cap distinct buckets at %d even under %d resigned labels from one key, got %d", maxBuckets, attempts+1, n)
+	}
+}
+
+func TestPacketExpiredTTL(t *testing.T) {
+	replaySkew = 30 * time.Second
+
+	expired := &Packet{Ttl: time.Now().Add(-time.Minute).Unix()}
+	if !packetExpired(expired) {
+		t.Fatalf("expected a packet with a past Ttl to be expired")
+	}
+
+	fresh := &Packet{Ttl: time.Now().Add(time.Minute).Unix()}
+	if packetExpired(fresh) {
+		t.Fatalf("expected a packet with a future Ttl to not be expired")
+	}
+
+	noTTL := &Packet{}
+	if packetExpired(noTTL) {
+		t.Fatalf("expected a packet with no Ttl to not be expired")
+	}
+}
+
+func TestSeenBucketAgedBloomRotates(t *testing.T) {
+	orig := replayWindow
+	replayWindow = time.Millisecond
+	defer func() { replayWindow = orig }()
+
+	b := newSeenBucket(1)
+	expiry := time.Now().Add(time.Minute)
+
+	// Force every id straight into the aged bloom by keeping ring capacity
+	// at 1: each new id evicts the previous one into agedCur.
+	for i := 0; i < 50; i++ {
+		b.checkAndRemember("id-"+string(rune('a'+i%26)), expiry)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	b.mu.Lock()
+	full := true
+	for _, word := range b.agedCur.bits {
+		if word != ^uint64(0) {
+			full = false
+			break
+		}
+	}
+	b.mu.Unlock()
+	if full {
+		t.Fatalf("expected agedCur to be rotated out before saturating, even after many ids")
+	}
+
+	// "id-a" last aged out of the ring at i=27, many rotations ago, so
+	// neither bloom generation still holds it.
+	if b.checkAndRemember("id-a", expiry) {
+		t.Fatalf("expected an id aged out several windows ago to be forgotten once the blooms rotated")
+	}
+}
+
+// TestHandleConnectionDropsForgedSrcBeforeCachingIt drives real signed
+// packets through handleConnection, each claiming a freshly-minted, unique
+// Src that doesn't belong to its (also freshly-minted) signing key — an
+// attacker who never registers a real identity can produce an unbounded
+// number of these. None of them should make it far enough to allocate a
+// seenBucket: the Src-to-key binding check must run before the seen-ID cache
+// ever sees the packet.
+func TestHandleConnectionDropsForgedSrcBeforeCachingIt(t *testing.T) {
+	resetRoutingTables()
+	globalSeenCache = newSeenCache(16)
+	insecureNoEncryption = true
+	defer func() { insecureNoEncryption = false }()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go handleConnection(server)
+
+	sign := func(p *Packet, priv ed25519.PrivateKey, pub ed25519.PublicKey) {
+		p.Pk = pub
+		signCopy := &Packet{Typ: p.Typ, Id: p.Id, Src: p.Src, Dst: p.Dst, Body: p.Body, Fee: p.Fee, Ttl: p.Ttl, Scar: p.Scar}
+		data, err := proto.Marshal(signCopy)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		p.Sig = ed25519.Sign(priv, data)
+	}
+
+	const attempts = 50
+	for i := 0; i < attempts; i++ {
+		pub, priv := mustGenKey(t)
+		p := &Packet{Typ: 1, Id: fmt.Sprintf("id-%d", i), Src: fmt.Sprintf("bot:forged-%d@notarealhash", i), Dst: "server"}
+		sign(p, priv, pub)
+		if err := writePacket(client, p); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+	}
+
+	// A final, Src-less packet forces a reply: by the time it arrives,
+	// handleConnection's single reader goroutine must have already finished
+	// processing (and dropping) all 50 forged packets above.
+	sentinelPub, sentinelPriv := mustGenKey(t)
+	sentinel := &Packet{Typ: 1, Id: "sentinel", Dst: "server"}
+	sign(sentinel, sentinelPriv, sentinelPub)
+	if err := writePacket(client, sentinel); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	if _, err := readPacket(client); err != nil {
+		t.Fatalf("readPacket: %v", err)
+	}
+
+	globalSeenCache.mu.Lock()
+	n := len(globalSeenCache.buckets)
+	globalSeenCache.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected no seenBucket to be allocated for forged, unregistered sources, got %d", n)
+	}
+}
+
+func TestPacketExpiredWithinClockSkew(t *testing.T) {
+	replaySkew = 30 * time.Second
+
+	// Deadline 10s in the past: within the 30s skew tolerance, so not expired.
+	p := &Packet{Ttl: time.Now().Add(-10 * time.Second).Unix()}
+	if packetExpired(p) {
+		t.Fatalf("expected a packet within clock-skew tolerance to not be expired")
+	}
+
+	// Deadline 60s in the past: outside the 30s skew tolerance.
+	p2 := &Packet{Ttl: time.Now().Add(-60 * time.Second).Unix()}
+	if !packetExpired(p2) {
+		t.Fatalf("expected a packet beyond clock-skew tolerance to be expired")
+	}
+}
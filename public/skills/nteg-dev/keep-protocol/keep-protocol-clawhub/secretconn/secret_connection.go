@@ -0,0 +1,302 @@
+// Package secretconn implements an authenticated, encrypted transport
+// inspired by Tendermint's p2p SecretConn: an ephemeral X25519 handshake
+// establishes a shared secret, which keys two independent ChaCha20-Poly1305
+// AEADs (one per direction) wrapped around the connection, and is then used
+// to authenticate each side's long-term ed25519 identity over the now-
+// encrypted channel — a Station-to-Station-style binding of ephemeral keys
+// to long-term keys.
+package secretconn
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// dataFrameSize is the plaintext payload size of a single AEAD frame,
+// mirroring Tendermint's fixed 1024-byte SecretConn frames. The first two
+// bytes of the plaintext carry the true length of the chunk so the final,
+// short frame doesn't need to reveal its length on the wire.
+const dataFrameSize = 1024
+
+// totalFrameSize is the on-wire size of one frame.
+const totalFrameSize = dataFrameSize + chacha20poly1305.Overhead
+
+// SecretConn is a net.Conn that transparently encrypts and authenticates
+// everything written to, and decrypts everything read from, the underlying
+// connection. It is only ever constructed by a successful Handshake.
+//
+// Write and Read are each safe for concurrent use by multiple goroutines
+// (serialized internally via sendMu/recvMu), since the keep server's routing
+// code writes to a given agent's connection from more than one goroutine at
+// once.
+type SecretConn struct {
+	conn net.Conn
+
+	sendMu     sync.Mutex
+	sendCipher cipher.AEAD
+	sendNonce  *nonceCounter
+
+	recvMu     sync.Mutex
+	recvCipher cipher.AEAD
+	recvNonce  *nonceCounter
+	recvBuf    []byte // leftover decrypted plaintext from the last frame
+
+	remotePubKey ed25519.PublicKey
+}
+
+// RemotePubKey returns the long-term ed25519 identity the handshake
+// authenticated for the remote side of the connection.
+func (sc *SecretConn) RemotePubKey() ed25519.PublicKey { return sc.remotePubKey }
+
+func (sc *SecretConn) Read(data []byte) (int, error) {
+	sc.recvMu.Lock()
+	defer sc.recvMu.Unlock()
+
+	if len(sc.recvBuf) > 0 {
+		n := copy(data, sc.recvBuf)
+		sc.recvBuf = sc.recvBuf[n:]
+		return n, nil
+	}
+
+	sealed := make([]byte, totalFrameSize)
+	if _, err := io.ReadFull(sc.conn, sealed); err != nil {
+		return 0, err
+	}
+	plain, err := sc.recvCipher.Open(nil, sc.recvNonce.next(), sealed, nil)
+	if err != nil {
+		return 0, fmt.Errorf("secretconn: decrypt frame: %w", err)
+	}
+
+	frameLen := int(binary.BigEndian.Uint16(plain[:2]))
+	if frameLen > dataFrameSize-2 {
+		return 0, errors.New("secretconn: corrupt frame length")
+	}
+	n := copy(data, plain[2:2+frameLen])
+	if n < frameLen {
+		sc.recvBuf = append(sc.recvBuf, plain[2+n:2+frameLen]...)
+	}
+	return n, nil
+}
+
+func (sc *SecretConn) Write(data []byte) (int, error) {
+	sc.sendMu.Lock()
+	defer sc.sendMu.Unlock()
+
+	total := 0
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > dataFrameSize-2 {
+			chunk = chunk[:dataFrameSize-2]
+		}
+
+		var plain [dataFrameSize]byte
+		binary.BigEndian.PutUint16(plain[:2], uint16(len(chunk)))
+		copy(plain[2:], chunk)
+
+		sealed := sc.sendCipher.Seal(nil, sc.sendNonce.next(), plain[:], nil)
+		if _, err := sc.conn.Write(sealed); err != nil {
+			return total, err
+		}
+		total += len(chunk)
+		data = data[len(chunk):]
+	}
+	return total, nil
+}
+
+func (sc *SecretConn) Close() error                       { return sc.conn.Close() }
+func (sc *SecretConn) LocalAddr() net.Addr                { return sc.conn.LocalAddr() }
+func (sc *SecretConn) RemoteAddr() net.Addr               { return sc.conn.RemoteAddr() }
+func (sc *SecretConn) SetDeadline(t time.Time) error      { return sc.conn.SetDeadline(t) }
+func (sc *SecretConn) SetReadDeadline(t time.Time) error  { return sc.conn.SetReadDeadline(t) }
+func (sc *SecretConn) SetWriteDeadline(t time.Time) error { return sc.conn.SetWriteDeadline(t) }
+
+// nonceCounter produces the monotonically increasing per-direction nonces
+// ChaCha20-Poly1305 requires: a 64-bit big-endian counter in the last 8 bytes
+// of the 96-bit nonce (the first 4 bytes stay zero), incremented after every
+// frame. Reusing a nonce would break confidentiality outright, so each
+// direction gets its own counter starting at zero.
+type nonceCounter struct {
+	counter uint64
+	buf     [chacha20poly1305.NonceSize]byte
+}
+
+func (n *nonceCounter) next() []byte {
+	binary.BigEndian.PutUint64(n.buf[chacha20poly1305.NonceSize-8:], n.counter)
+	n.counter++
+	return n.buf[:]
+}
+
+// Handshake performs the Station-to-Station-style key exchange and identity
+// authentication over conn, then returns a SecretConn wrapping it.
+//
+// Both sides send an ephemeral X25519 public key, derive a shared secret via
+// ECDH, and use HKDF over that secret to key two independent
+// ChaCha20-Poly1305 ciphers, one per direction (ordered by comparing the two
+// ephemeral public keys so both sides agree on which derived key is "send"
+// vs "recv" without further negotiation). Each side then signs a transcript
+// of both ephemeral keys with its long-term ed25519 key and exchanges that
+// signature *through* the now-encrypted channel, binding the long-term
+// identity to this specific ephemeral exchange.
+func Handshake(conn net.Conn, localPrivKey ed25519.PrivateKey) (*SecretConn, error) {
+	localEphPub, localEphPriv, err := newEphemeralKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("secretconn: generate ephemeral key: %w", err)
+	}
+
+	remoteEphPub, err := exchangeEphemeralPubKeys(conn, localEphPub)
+	if err != nil {
+		return nil, fmt.Errorf("secretconn: exchange ephemeral keys: %w", err)
+	}
+
+	shared, err := curve25519.X25519(localEphPriv[:], remoteEphPub[:])
+	if err != nil {
+		return nil, fmt.Errorf("secretconn: ecdh: %w", err)
+	}
+
+	loKey, hiKey, loFirst := deriveDirectionalKeys(shared, localEphPub, remoteEphPub)
+	sendKey, recvKey := hiKey, loKey
+	if loFirst {
+		sendKey, recvKey = loKey, hiKey
+	}
+
+	sendAEAD, err := chacha20poly1305.New(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recvAEAD, err := chacha20poly1305.New(recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &SecretConn{
+		conn:       conn,
+		sendCipher: sendAEAD,
+		recvCipher: recvAEAD,
+		sendNonce:  &nonceCounter{},
+		recvNonce:  &nonceCounter{},
+	}
+
+	transcript := transcriptHash(localEphPub, remoteEphPub)
+	localSig := ed25519.Sign(localPrivKey, transcript)
+	localIdentityPub, _ := localPrivKey.Public().(ed25519.PublicKey)
+
+	remotePub, remoteSig, err := exchangeIdentityProof(sc, localIdentityPub, localSig)
+	if err != nil {
+		return nil, fmt.Errorf("secretconn: exchange identity proof: %w", err)
+	}
+	if !ed25519.Verify(remotePub, transcript, remoteSig) {
+		return nil, errors.New("secretconn: remote failed to prove its long-term identity")
+	}
+	sc.remotePubKey = remotePub
+
+	return sc, nil
+}
+
+func newEphemeralKeyPair() (pub, priv [32]byte, err error) {
+	if _, err = io.ReadFull(rand.Reader, priv[:]); err != nil {
+		return
+	}
+	pubSlice, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	copy(pub[:], pubSlice)
+	return
+}
+
+func exchangeEphemeralPubKeys(conn net.Conn, localPub [32]byte) (remotePub [32]byte, err error) {
+	writeErr := make(chan error, 1)
+	go func() {
+		_, werr := conn.Write(localPub[:])
+		writeErr <- werr
+	}()
+	if _, err = io.ReadFull(conn, remotePub[:]); err != nil {
+		return
+	}
+	if err = <-writeErr; err != nil {
+		return
+	}
+	return remotePub, nil
+}
+
+// deriveDirectionalKeys derives two independent 32-byte ChaCha20-Poly1305
+// keys from the ECDH shared secret via HKDF, one for each direction.
+// loFirst reports whether the local side holds the numerically lower
+// ephemeral public key, which both sides use to agree on which derived key
+// is "send" vs "recv".
+func deriveDirectionalKeys(shared []byte, localEphPub, remoteEphPub [32]byte) (loKey, hiKey []byte, loFirst bool) {
+	loFirst = lexLess(localEphPub[:], remoteEphPub[:])
+	lo, hi := remoteEphPub, localEphPub
+	if loFirst {
+		lo, hi = localEphPub, remoteEphPub
+	}
+
+	salt := append(append([]byte{}, lo[:]...), hi[:]...)
+	h := hkdf.New(sha256.New, shared, salt, []byte("keep secretconn v1"))
+	out := make([]byte, 64)
+	if _, err := io.ReadFull(h, out); err != nil {
+		// hkdf.Read only fails if more output than its theoretical max is
+		// requested, which never happens for a fixed 64-byte request.
+		panic("secretconn: hkdf: " + err.Error())
+	}
+	return out[:32], out[32:], loFirst
+}
+
+func lexLess(a, b []byte) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+func transcriptHash(localEphPub, remoteEphPub [32]byte) []byte {
+	lo, hi := remoteEphPub, localEphPub
+	if lexLess(localEphPub[:], remoteEphPub[:]) {
+		lo, hi = localEphPub, remoteEphPub
+	}
+	sum := sha256.Sum256(append(append([]byte{}, lo[:]...), hi[:]...))
+	return sum[:]
+}
+
+const identityProofSize = ed25519.PublicKeySize + ed25519.SignatureSize
+
+// exchangeIdentityProof sends the local identity proof and receives the
+// remote's over sc, which is already encrypted at this point.
+func exchangeIdentityProof(sc *SecretConn, localPub ed25519.PublicKey, localSig []byte) (ed25519.PublicKey, []byte, error) {
+	local := make([]byte, 0, identityProofSize)
+	local = append(local, localPub...)
+	local = append(local, localSig...)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, werr := sc.Write(local)
+		writeErr <- werr
+	}()
+
+	remote := make([]byte, identityProofSize)
+	if _, err := io.ReadFull(sc, remote); err != nil {
+		return nil, nil, err
+	}
+	if err := <-writeErr; err != nil {
+		return nil, nil, err
+	}
+
+	remotePub := ed25519.PublicKey(append([]byte{}, remote[:ed25519.PublicKeySize]...))
+	remoteSig := append([]byte{}, remote[ed25519.PublicKeySize:]...)
+	return remotePub, remoteSig, nil
+}
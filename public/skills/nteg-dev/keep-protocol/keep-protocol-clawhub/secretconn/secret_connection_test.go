@@ -0,0 +1,139 @@
+package secretconn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"testing"
+)
+
+func TestHandshakeAndRoundTrip(t *testing.T) {
+	_, aPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	bPub, bPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	aConn, bConn := net.Pipe()
+	defer aConn.Close()
+	defer bConn.Close()
+
+	type result struct {
+		sc  *SecretConn
+		err error
+	}
+	aCh := make(chan result, 1)
+	bCh := make(chan result, 1)
+	go func() { sc, err := Handshake(aConn, aPriv); aCh <- result{sc, err} }()
+	go func() { sc, err := Handshake(bConn, bPriv); bCh <- result{sc, err} }()
+
+	a := <-aCh
+	b := <-bCh
+	if a.err != nil {
+		t.Fatalf("A handshake: %v", a.err)
+	}
+	if b.err != nil {
+		t.Fatalf("B handshake: %v", b.err)
+	}
+
+	if !bytes.Equal(a.sc.RemotePubKey(), bPub) {
+		t.Fatalf("A did not authenticate B's long-term key")
+	}
+
+	msg := []byte("hello over an encrypted channel")
+	writeErr := make(chan error, 1)
+	go func() { _, err := a.sc.Write(msg); writeErr <- err }()
+
+	got := make([]byte, len(msg))
+	if _, err := readFull(b.sc, got); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+}
+
+func TestConcurrentWritesDoNotRaceOrReuseNonces(t *testing.T) {
+	_, aPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	_, bPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	aConn, bConn := net.Pipe()
+	defer aConn.Close()
+	defer bConn.Close()
+
+	type result struct {
+		sc  *SecretConn
+		err error
+	}
+	aCh := make(chan result, 1)
+	bCh := make(chan result, 1)
+	go func() { sc, err := Handshake(aConn, aPriv); aCh <- result{sc, err} }()
+	go func() { sc, err := Handshake(bConn, bPriv); bCh <- result{sc, err} }()
+
+	a := <-aCh
+	b := <-bCh
+	if a.err != nil {
+		t.Fatalf("A handshake: %v", a.err)
+	}
+	if b.err != nil {
+		t.Fatalf("B handshake: %v", b.err)
+	}
+
+	const writers = 8
+	const msgLen = 16
+
+	done := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			msg := bytes.Repeat([]byte{byte(i)}, msgLen)
+			_, err := a.sc.Write(msg)
+			done <- err
+		}(i)
+	}
+
+	seen := make(map[byte]int)
+	for i := 0; i < writers; i++ {
+		got := make([]byte, msgLen)
+		if _, err := readFull(b.sc, got); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		for _, c := range got[1:] {
+			if c != got[0] {
+				t.Fatalf("frame corrupted by concurrent writers: %v", got)
+			}
+		}
+		seen[got[0]]++
+	}
+	for i := 0; i < writers; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if len(seen) != writers {
+		t.Fatalf("expected %d distinct messages, got %d: %v", writers, len(seen), seen)
+	}
+}
+
+func readFull(r interface{ Read([]byte) (int, error) }, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := r.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}